@@ -23,8 +23,13 @@
 # FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
 # DEALINGS IN THE SOFTWARE.
 
+import io
+import os
+import re
 import sys
 import codecs
+import argparse
+import datetime
 import unicodedata
 
 nline = 0
@@ -34,6 +39,21 @@ warnings = 0
 errors = 0
 skip_order_check = False
 
+# rules with more labels than this get a warning, unless they are listed in the allowlist
+max_labels = 4
+deep_rules = set()
+
+# comment lines longer than this (in characters) get a warning
+max_comment_length = 150
+
+# size budgets in bytes, consumers embedding the list care about its size
+max_size = 256000
+max_icann_size = 200000
+max_private_size = 64000
+
+# special-use domain names, read from special_use.txt by default
+special_use = set()
+
 def warning(msg):
 	global warnings, orig_line, nline
 	print('%d: warning: %s%s' % (nline, msg, ": \'" + orig_line + "\'" if orig_line else ""))
@@ -45,6 +65,39 @@ def error(msg):
 	errors += 1
 #	skip_order_check = True
 
+# Unicode bidirectional formatting characters (UAX #9), they may reorder how text is displayed
+BIDI_CHARS = set([0x061C, 0x200E, 0x200F]) | set(range(0x202A, 0x202F)) | set(range(0x2066, 0x206A))
+
+# Invisible format characters: soft hyphen, Mongolian vowel separator, zero width space, word joiner,
+# invisible operators and zero width no-break space. ZWNJ and ZWJ are not listed, IDN labels may
+# contain them (RFC 5892, CONTEXTJ).
+ZERO_WIDTH_CHARS = set([0x00AD, 0x180E, 0x200B, 0xFEFF]) | set(range(0x2060, 0x2065))
+JOINER_CHARS = set([0x200C, 0x200D])
+
+def invisible_char(c):
+	"""Returns True for control, bidi and zero width characters, except TAB and CR which are reported as whitespace"""
+	return (c not in '\t\r' and unicodedata.category(c) == 'Cc') or ord(c) in BIDI_CHARS or ord(c) in ZERO_WIDTH_CHARS
+
+# something that looks like a date, with the year first or last
+DATE_RE = re.compile(r'(?<![\w/.:-])(\d{4}[-/.]\d{1,2}[-/.]\d{1,2}|\d{1,2}[-/.]\d{1,2}[-/.]\d{4})(?![\w/.-])')
+ISO_DATE_RE = re.compile(r'^(\d{4})-(\d{2})-(\d{2})$')
+
+def check_dates(comment):
+	"""Check that dates in a comment are valid and in YYYY-MM-DD format"""
+	# ignore URLs, they often contain dates in their paths
+	text = " ".join(word for word in comment.split() if '://' not in word and word[0:4] != 'www.')
+
+	for date in DATE_RE.findall(text):
+		m = ISO_DATE_RE.match(date)
+		if not m:
+			warning('Date \'%s\' not in YYYY-MM-DD format' % date)
+			continue
+
+		try:
+			datetime.date(int(m.group(1)), int(m.group(2)), int(m.group(3)))
+		except ValueError:
+			warning('Invalid date \'%s\'' % date)
+
 def print_psl(list):
 	for domain in list:
 		print(".".join(str(label) for label in reversed(domain)))
@@ -83,8 +136,18 @@ def check_order(group):
 		del group[:]
 
 
-def lint_psl(infile):
-	"""Parses PSL file and performs syntax checking"""
+def next_rule(lines, n):
+	"""Returns the first rule of lines[n:] before the next empty line, or None"""
+	for line in lines[n:]:
+		line = line.strip()
+		if not line:
+			return None
+		if line[0:2] != "//":
+			return line
+	return None
+
+def lint_psl(infile, encoding_errors):
+	"""Parses PSL file and performs syntax checking, encoding_errors are the per-line errors of check_encoding()"""
 	global orig_line, nline
 
 	PSL_FLAG_EXCEPTION = (1<<0)
@@ -99,12 +162,26 @@ def lint_psl(infile):
 	section = 0
 	icann_sections = 0
 	private_sections = 0
+	icann_generated = False # the new gTLDs are generated and checked by tools/newgtlds
+	prev_tld = None
+	block_rules = False # the current block has rules
+	size = 0
+	section_size = 0
 
 	lines = [line.strip('\n') for line in infile]
 
 	for line in lines:
 		nline += 1
 
+		# size of the line in the file, including the newline
+		line_size = len(line.encode('utf-8', 'surrogateescape')) + 1
+		size += line_size
+		section_size += line_size
+
+		for msg in encoding_errors.get(nline, []):
+			orig_line = None
+			error(msg)
+
 		# check for leading/trailing whitespace
 		stripped = line.strip()
 		if stripped != line:
@@ -115,11 +192,45 @@ def lint_psl(infile):
 		orig_line = line
 		line = stripped
 
+		# check for control characters and invisible formatting characters, also in comments
+		invisible = [c for c in line if invisible_char(c)]
+		if invisible:
+			orig_line = "".join('\\u%04x' % ord(c) if invisible_char(c) else c for c in orig_line)
+			if any(ord(c) in BIDI_CHARS for c in invisible):
+				error('Bidirectional control character')
+			else:
+				error('Control or invisible character U+%04X' % ord(invisible[0]))
+			if line[0:2] != "//":
+				continue
+
 		# empty line (end of sorted domain group)
 		if not line:
 			# check_order(group)
 			continue
 
+		# first line of a block, i.e. after an empty line or the begin of a section
+		block_start = nline == 1 or lines[nline - 2].strip() in ("", "// ===BEGIN ICANN DOMAINS===", "// ===BEGIN PRIVATE DOMAINS===")
+		if block_start:
+			block_rules = False
+
+		# the TLD blocks of the ICANN section start with a '// <tld> :' comment and are sorted by TLD
+		if section == PSL_FLAG_ICANN and line == "// newGTLDs":
+			icann_generated = True
+		elif section == PSL_FLAG_ICANN and block_start and not icann_generated:
+			rule = next_rule(lines, nline - 1)
+			header = re.match(r'^// ([^\s:]+) ?:(?!//)', line) # not the scheme of a URL
+			tld = rule.split('.')[-1] if rule else None
+
+			if rule and not all(ord(c) < 128 for c in tld):
+				# IDN ccTLDs have their own sub-section, sorted by ISO 3166 code
+				prev_tld = None
+			elif rule and tld != prev_tld: # further blocks of the same TLD don't need their own header
+				if not header or (header.group(1) != tld and not header.group(1).endswith('.' + tld)):
+					warning('TLD block for \'%s\' does not start with \'// %s :\'' % (tld, tld))
+				if prev_tld and tld < prev_tld:
+					warning('TLD block for \'%s\' not in alphabetical order, it follows \'%s\'' % (tld, prev_tld))
+				prev_tld = tld
+
 		# check for section begin/end
 		if line[0:2] == "//":
 			# check_order(group)
@@ -128,9 +239,11 @@ def lint_psl(infile):
 				if line == "// ===BEGIN ICANN DOMAINS===":
 					section = PSL_FLAG_ICANN
 					icann_sections += 1
+					section_size = line_size
 				elif line == "// ===BEGIN PRIVATE DOMAINS===":
 					section = PSL_FLAG_PRIVATE
 					private_sections += 1
+					section_size = line_size
 				elif line[3:11] == "===BEGIN":
 					error('Unexpected begin of unknown section')
 				elif line[3:9] == "===END":
@@ -138,6 +251,8 @@ def lint_psl(infile):
 			elif section == PSL_FLAG_ICANN:
 				if line == "// ===END ICANN DOMAINS===":
 					section = 0
+					if section_size > max_icann_size:
+						warning('ICANN section has %d bytes, more than %d' % (section_size, max_icann_size))
 				elif line[3:11] == "===BEGIN":
 					error('Unexpected begin of section: ')
 				elif line[3:9] == "===END":
@@ -145,30 +260,44 @@ def lint_psl(infile):
 			elif section == PSL_FLAG_PRIVATE:
 				if line == "// ===END PRIVATE DOMAINS===":
 					section = 0
+					if section_size > max_private_size:
+						warning('PRIVATE section has %d bytes, more than %d' % (section_size, max_private_size))
 				elif line[3:11] == "===BEGIN":
 					error('Unexpected begin of section')
 				elif line[3:9] == "===END":
 					error('Unexpected end of section')
 
+			# comments of the PRIVATE section belong to a block of rules, except the one after the section begin
+			if section == PSL_FLAG_PRIVATE and line != "// ===BEGIN PRIVATE DOMAINS===" and not next_rule(lines, nline):
+				if block_start and lines[nline - 2].strip() != "// ===BEGIN PRIVATE DOMAINS===":
+					warning('Comment block without rules')
+				elif block_rules:
+					warning('Comment not attached to a block')
+
+			if len(line) > 2 and line[2] != ' ':
+				warning('Comment without space after //')
+
+			if len(line) > max_comment_length:
+				warning('Comment longer than %d characters' % max_comment_length)
+
+			check_dates(line)
+
 			continue # processing of comments ends here
 
+		block_rules = True
+
 		# No rule must be outside of a section
 		if section == 0:
 			error('Rule outside of section')
 
-		group.append(list(reversed(line.split('.'))))
-
-		# decode UTF-8 input into unicode, needed only for python 2.x
-		try:
-			if sys.version_info[0] < 3:
-				line = line.decode('utf-8')
-			else:
-				line.encode('utf-8')
-		except (UnicodeDecodeError, UnicodeEncodeError):
-			orig_line = None
-			error('Invalid UTF-8 character')
+		# tabs, spaces and non-breaking spaces inside a rule are split differently by different parsers
+		if any(c.isspace() for c in line):
+			orig_line = "".join('\\u%04x' % ord(c) if c.isspace() and ord(c) >= 128 else c for c in orig_line.replace('\t', '\\t'))
+			error('Whitespace within rule')
 			continue
 
+		group.append(list(reversed(line.split('.'))))
+
 		# rules must be NFC coded (Unicode's Normal Form Kanonical Composition)
 		if unicodedata.normalize("NFKC", line) != line:
 			error('Rule must be NFKC')
@@ -177,6 +306,11 @@ def lint_psl(infile):
 		if line != line.lower():
 			error('Rule must be lowercase')
 
+		# very deep rules are discouraged, existing ones are allowlisted
+		depth = len(line.lstrip('!').split('.'))
+		if depth > max_labels and line not in deep_rules:
+			warning('Rule has %d labels, more than %d' % (depth, max_labels))
+
 		# strip leading wildcards
 		flags = section
 		# while line[0:2] == '*.':
@@ -197,6 +331,10 @@ def lint_psl(infile):
 
 		labels = line.split('.')
 
+		# an exception doesn't make a name public, so it is fine for special-use names
+		if not flags & PSL_FLAG_EXCEPTION and any(line == name or line.endswith('.' + name) for name in special_use):
+			error('Special-use domain name')
+
 		if flags & PSL_FLAG_EXCEPTION and len(labels) > 1:
 			domain = ".".join(str(label) for label in labels[1:])
 			if not domain in line2flag:
@@ -204,19 +342,44 @@ def lint_psl(infile):
 			elif not line2flag[domain] & PSL_FLAG_WILDCARD:
 				error('Exception without previous wildcard')
 
+		if not labels[0]:
+			error('Leading dot')
+		elif not labels[-1]:
+			error('Trailing dot')
+		elif '' in labels:
+			error('Multiple dots')
+
 		for label in labels:
 			if not label:
-				error('Leading/trailing or multiple dot')
 				continue
 
 			if label[0:4] == 'xn--':
 				error('Punycode found')
 				continue
 
+			# labels with hyphens in the 3rd and 4th position are reserved (RFC 5891, section 4.2.3.1)
+			if label[2:4] == '--':
+				error('Reserved double minus at label position 3-4')
+				continue
+
 			if '--' in label:
 				error('Double minus found')
 				continue
 
+			if label[0] == '-':
+				error('Label starts with minus')
+				continue
+
+			if label[-1] == '-':
+				error('Label ends with minus')
+				continue
+
+			# ZWNJ and ZWJ only join characters of scripts that need them, never ASCII ones
+			if any(ord(c) in JOINER_CHARS for c in label) and all(ord(c) < 128 or ord(c) in JOINER_CHARS for c in label):
+				orig_line = "".join('\\u%04x' % ord(c) if ord(c) in JOINER_CHARS else c for c in orig_line)
+				error('Zero width joiner in ASCII label')
+				continue
+
 			# allowed are a-z,0-9,- and unicode >= 128 (maybe that can be finetuned a bit !?)
 			for c in label:
 				if not c.isalnum() and c != '-' and ord(c) < 128:
@@ -239,6 +402,9 @@ def lint_psl(infile):
 
 	orig_line = None
 
+	if size > max_size:
+		warning('File has %d bytes, more than %d' % (size, max_size))
+
 	if section == PSL_FLAG_ICANN:
 		error('ICANN section not closed')
 	elif section == PSL_FLAG_PRIVATE:
@@ -254,20 +420,74 @@ def lint_psl(infile):
 	elif private_sections > 1:
 		warning('%d PRIVATE sections found' % private_sections)
 
-def usage():
-	"""Prints the usage"""
-	print('usage: %s PSLfile' % sys.argv[0])
-	print('or     %s -        # To read PSL from STDIN' % sys.argv[0])
-	exit(1)
+def check_encoding(data):
+	"""Check that the raw file content is UTF-8 without BOM, returns the content without BOM and the errors by line number"""
+	errors = {}
 
+	offset = 0
+	if data[0:3] == codecs.BOM_UTF8:
+		errors[1] = ['UTF-8 BOM found']
+		offset = 3
+
+	while offset < len(data):
+		try:
+			data[offset:].decode('utf-8')
+			break
+		except UnicodeDecodeError as e:
+			start = offset + e.start
+			n = data.count(b'\n', 0, start) + 1
+			# UTF-16 surrogates (U+D800..U+DFFF) are encoded as ED A0..BF xx
+			if data[start] == 0xED and b'\xa0' <= data[start + 1:start + 2] <= b'\xbf':
+				errors.setdefault(n, []).append('UTF-16 surrogate at byte offset %d' % start)
+				offset = start + 3
+			else:
+				errors.setdefault(n, []).append('Invalid UTF-8 at byte offset %d' % start)
+				offset = offset + e.end
+
+	return data[3:] if data[0:3] == codecs.BOM_UTF8 else data, errors
+
+def read_rules(filename):
+	"""Reads a set of rules, one rule per line, skipping comments and empty lines"""
+	with open(filename, 'r', encoding='utf-8') as f:
+		return set(line.strip() for line in f if line.strip() and line[0:2] != '//')
 
 def main():
 	"""Check syntax of a PSL file"""
-	if len(sys.argv) < 2:
-		usage()
-
-	with sys.stdin if sys.argv[-1] == '-' else open(sys.argv[-1], 'r', encoding='utf-8', errors="surrogateescape") as infile:
-		lint_psl(infile)
+	global max_labels, deep_rules, special_use, max_comment_length, max_size, max_icann_size, max_private_size
+
+	linter_dir = os.path.dirname(os.path.abspath(__file__))
+
+	parser = argparse.ArgumentParser(description='Check syntax of a PSL file')
+	parser.add_argument('--max-labels', type=int, default=max_labels, metavar='N',
+		help='warn about rules with more than N labels (default %(default)d)')
+	parser.add_argument('--deep-rules', default=os.path.join(linter_dir, 'deep_rules.txt'), metavar='FILE',
+		help='allowlist of rules exceeding --max-labels (default deep_rules.txt)')
+	parser.add_argument('--max-comment-length', type=int, default=max_comment_length, metavar='N',
+		help='warn about comment lines longer than N characters (default %(default)d)')
+	parser.add_argument('--max-size', type=int, default=max_size, metavar='N',
+		help='warn if the file is larger than N bytes (default %(default)d)')
+	parser.add_argument('--max-icann-size', type=int, default=max_icann_size, metavar='N',
+		help='warn if the ICANN section is larger than N bytes (default %(default)d)')
+	parser.add_argument('--max-private-size', type=int, default=max_private_size, metavar='N',
+		help='warn if the PRIVATE section is larger than N bytes (default %(default)d)')
+	parser.add_argument('--special-use', default=os.path.join(linter_dir, 'special_use.txt'), metavar='FILE',
+		help='list of special-use domain names (default special_use.txt)')
+	parser.add_argument('psl_file', metavar='PSLfile',
+		help='PSL file to check, - to read it from STDIN')
+	args = parser.parse_args()
+
+	max_labels = args.max_labels
+	max_comment_length = args.max_comment_length
+	max_size = args.max_size
+	max_icann_size = args.max_icann_size
+	max_private_size = args.max_private_size
+	deep_rules = read_rules(args.deep_rules)
+	special_use = read_rules(args.special_use)
+
+	with sys.stdin.buffer if args.psl_file == '-' else open(args.psl_file, 'rb') as infile:
+		data, encoding_errors = check_encoding(infile.read())
+
+	lint_psl(io.TextIOWrapper(io.BytesIO(data), encoding='utf-8', errors="surrogateescape"), encoding_errors)
 
 	return errors != 0
 
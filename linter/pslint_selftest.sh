@@ -9,7 +9,8 @@ sed -i -e 's/^e.example.com$/e.example.com\r/g' test_spaces.input
 
 for file in `ls *.input|cut -d'.' -f1`; do
   echo -n "${file}: "
-  ./pslint.py ${file}.input >log/${file}.log 2>&1
+  args=`cat ${file}.args 2>/dev/null`
+  ./pslint.py --special-use=test_special_use.txt $args ${file}.input >log/${file}.log 2>&1
   diff -u ${file}.expected log/${file}.log >log/${file}.diff
   if [ $? -eq 0 ]; then
     echo OK
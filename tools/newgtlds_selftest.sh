@@ -0,0 +1,34 @@
+#!/bin/sh
+#
+# Runs newgtlds for each testdata/<test>.expected on testdata/<test>.csv with
+# testdata/<test>.dat as the PSL file and the options in testdata/<test>.args,
+# if any, then compares stdout and stderr with testdata/<test>.expected.
+# The options may name other files, e.g. the shared testdata/gtlds.csv.
+
+python=${PYTHON:-python2}
+rc=0
+rm -rf log
+mkdir -p log
+
+for file in `cd testdata && ls *.expected|cut -d'.' -f1`; do
+  echo -n "${file}: "
+  args=`cat testdata/${file}.args 2>/dev/null`
+  $python ./newgtlds --url file:testdata/${file}.csv --psl-file testdata/${file}.dat $args >log/${file}.log 2>&1
+  echo "exit status $?" >>log/${file}.log
+  sed -i -e 's/ on [0-9-]*T[0-9:]*Z$/ on <timestamp>/' log/${file}.log
+  diff -u testdata/${file}.expected log/${file}.log >log/${file}.diff
+  if [ $? -eq 0 ]; then
+    echo OK
+    rm log/${file}.diff log/${file}.log
+  else
+    echo FAILED
+    cat log/${file}.diff
+    rc=1
+  fi
+done
+
+if [ $rc -eq 0 ]; then
+  rmdir log
+fi
+
+exit $rc